@@ -0,0 +1,166 @@
+package broker
+
+import (
+	stderrors "errors"
+
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GatewayEventType enumerates the gateway lifecycle events a Broker can
+// surface, regardless of which transport produced them.
+type GatewayEventType string
+
+const (
+	// GatewayConnected is raised when a gateway's ingress queue/subject/topic
+	// appears, i.e. the gateway just came online.
+	GatewayConnected GatewayEventType = "connected"
+	// GatewayDisconnected is raised when a gateway's ingress queue/subject/topic
+	// disappears, i.e. the gateway went offline.
+	GatewayDisconnected GatewayEventType = "disconnected"
+)
+
+// GatewayEvent is a transport-neutral notification about a gateway joining
+// or leaving the broker, derived from RabbitMQ's event exchange, NATS
+// presence/$SYS subjects or a retained MQTT "gateways/<id>/status" presence
+// topic depending on the configured driver. The MQTT driver does not use
+// $SYS/broker/clients (see broker/mqtt).
+type GatewayEvent struct {
+	GatewayID string
+	Type      GatewayEventType
+}
+
+// SubscribeOptions carries driver-specific tuning for a subscription. Not
+// every option applies to every driver - e.g. PrefetchCount only affects
+// broker/rabbitmq, which honours it by giving the subscription its own
+// channel with Ch.Qos(PrefetchCount, 0, false); drivers that have no
+// equivalent concept simply ignore it.
+type SubscribeOptions struct {
+	// PrefetchCount bounds how many unacknowledged deliveries the broker will
+	// buffer for this subscription before pausing, so a single misbehaving
+	// gateway can't flood memory. Zero means "use the driver's default".
+	PrefetchCount int
+
+	// DeadLetterExchange, when set, asks the driver to route deliveries the
+	// handler permanently rejects (see Permanent) to this exchange instead of
+	// discarding them, so poison messages can be inspected/replayed instead
+	// of vanishing. Only honoured by broker/rabbitmq.
+	DeadLetterExchange string
+
+	// WorkerPoolSize bounds how many deliveries for this subscription are
+	// handled concurrently. Zero means "use the driver's default". Only
+	// honoured by broker/rabbitmq, whose default is a pool of 16 workers.
+	WorkerPoolSize int
+}
+
+// SubscribeOption configures a Subscribe call.
+type SubscribeOption func(*SubscribeOptions)
+
+// WithPrefetchCount sets the subscription's QoS prefetch count.
+func WithPrefetchCount(n int) SubscribeOption {
+	return func(o *SubscribeOptions) { o.PrefetchCount = n }
+}
+
+// WithDeadLetterExchange routes deliveries permanently rejected by the
+// handler to exchange instead of discarding them.
+func WithDeadLetterExchange(exchange string) SubscribeOption {
+	return func(o *SubscribeOptions) { o.DeadLetterExchange = exchange }
+}
+
+// WithWorkerPoolSize bounds the number of deliveries handled concurrently
+// for this subscription.
+func WithWorkerPoolSize(n int) SubscribeOption {
+	return func(o *SubscribeOptions) { o.WorkerPoolSize = n }
+}
+
+// permanentError marks a Subscribe handler error as non-retryable: the
+// delivery is a poison message (malformed payload, unknown gateway, business
+// rejection) and should be dead-lettered rather than redelivered.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err to tell the Broker this delivery must not be retried:
+// the driver dead-letters it (or, lacking a DLX, simply discards it) instead
+// of redelivering.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err (or anything it wraps) was created by
+// Permanent.
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return stderrors.As(err, &pe)
+}
+
+// Broker abstracts the messaging transport used to talk to gateways, so the
+// business logic does not depend on RabbitMQ (or any other driver)
+// directly. Config selects an implementation by the URL scheme: amqp(s)://
+// for broker/rabbitmq, nats:// for broker/nats and mqtt(s):// for broker/mqtt.
+type Broker interface {
+	// Connect establishes (and, where the driver supports it, transparently
+	// maintains) the connection to the broker. It blocks until ctx is
+	// cancelled or an unrecoverable error occurs.
+	Connect(ctx context.Context) error
+
+	// Subscribe registers handler to be called with the payload of every
+	// message published to topic. A nil return acknowledges the delivery; an
+	// error not wrapped by Permanent asks for redelivery (subject to the
+	// driver's own retry/dead-lettering policy); an error wrapped by
+	// Permanent marks the delivery as a poison message that must not be
+	// retried.
+	Subscribe(topic string, handler func(msg []byte) error, opts ...SubscribeOption) error
+
+	// Publish sends msg to topic.
+	Publish(topic string, msg []byte) error
+
+	// Request sends msg to topic and blocks until a reply arrives or timeout
+	// elapses.
+	Request(topic string, msg []byte, timeout time.Duration) ([]byte, error)
+
+	// GatewayEvents returns a channel of gateway connect/disconnect
+	// notifications, translated from whatever mechanism the underlying
+	// transport uses to expose client presence.
+	GatewayEvents() <-chan GatewayEvent
+
+	// Close releases every resource held by the broker.
+	Close() error
+}
+
+// Constructor builds a driver-specific Broker from a parsed connection URL.
+// Drivers register themselves under the schemes they handle via Register,
+// mirroring the database/sql driver registry so this package never needs to
+// import broker/rabbitmq, broker/nats or broker/mqtt directly.
+type Constructor func(serverID string, u *url.URL) (Broker, error)
+
+var drivers = make(map[string]Constructor)
+
+// Register associates a URL scheme with a driver Constructor. It is meant to
+// be called from a driver package's init() function, e.g.:
+//
+//	import _ "github.com/AcroManiac/iot-cloud-server/internal/infrastructure/broker/rabbitmq"
+func Register(scheme string, constructor Constructor) {
+	drivers[scheme] = constructor
+}
+
+// NewBroker builds a Broker implementation for the given connection URL,
+// picking the driver by its scheme (amqp/amqps, nats, mqtt/mqtts). The
+// driver package implementing that scheme must be imported (directly or
+// blank-imported for its init side effect) for the scheme to be known here.
+func NewBroker(serverID, rawURL string) (Broker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing broker URL")
+	}
+
+	constructor, ok := drivers[u.Scheme]
+	if !ok {
+		return nil, errors.Errorf("unsupported broker URL scheme %q (driver package not imported?)", u.Scheme)
+	}
+	return constructor(serverID, u)
+}
@@ -17,58 +17,111 @@ import (
 	"github.com/AcroManiac/iot-cloud-server/internal/domain/interfaces"
 	"github.com/AcroManiac/iot-cloud-server/internal/domain/logic"
 	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/logger"
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/metrics"
+)
+
+const (
+	defaultRPCTimeout = 5 * time.Second
+
+	// defaultPrefetchCount bounds how many unacknowledged deliveries a
+	// gateway's ingress subscription may have buffered at once, so a single
+	// misbehaving gateway can't flood memory with buffered deliveries.
+	defaultPrefetchCount = 50
 
-	"github.com/streadway/amqp"
+	// defaultDeadLetterExchange is the per-server exchange poison ingress
+	// messages (malformed payloads, unknown gateways, rejected business
+	// logic) are routed to instead of being silently dropped.
+	defaultDeadLetterExchange = "iot.dlx"
+
+	// defaultWorkerPoolSize bounds how many ingress deliveries a gateway
+	// processes concurrently, so a burst of traffic can't grow goroutines
+	// unboundedly.
+	defaultWorkerPoolSize = 16
 )
 
+// GatewayChannel is constructed from the transport-neutral Broker interface
+// rather than a concrete amqp.Connection, so it works unmodified whichever
+// driver (broker/rabbitmq, broker/nats, broker/mqtt) is configured.
 type GatewayChannel struct {
-	serverId  string
-	gatewayId string
-	conn      *database.Connection
-	out       io.ReadCloser
-	in        io.WriteCloser
-	ctx       context.Context
-	cancel    context.CancelFunc
-	bl        interfaces.Logic
+	serverId           string
+	gatewayId          string
+	conn               *database.Connection
+	br                 Broker
+	prefetchCount      int
+	deadLetterExchange string
+	workerPoolSize     int
+	ctx                context.Context
+	cancel             context.CancelFunc
+	blMu               sync.Mutex
+	bl                 interfaces.Logic
 }
 
-func NewGatewayChannel(amqpConn *amqp.Connection, dbConn *database.Connection, serverId, gatewayId string) interfaces.Channel {
+func NewGatewayChannel(br Broker, dbConn *database.Connection, serverId, gatewayId string) interfaces.Channel {
 	// Create cancel context
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Create gateway reader and writer
-	out := NewAmqpReader(ctx, amqpConn, gatewayId)
-	if out == nil {
-		return nil
-	}
-	in := NewAmqpWriter(amqpConn, gatewayId)
-	if in == nil {
-		return nil
-	}
-
 	return &GatewayChannel{
-		serverId:  serverId,
-		gatewayId: gatewayId,
-		conn:      dbConn,
-		out:       out,
-		in:        in,
-		ctx:       ctx,
-		cancel:    cancel,
-		bl:        nil, // Do not create business logic until gateway status come
+		serverId:           serverId,
+		gatewayId:          gatewayId,
+		conn:               dbConn,
+		br:                 br,
+		prefetchCount:      defaultPrefetchCount,
+		deadLetterExchange: defaultDeadLetterExchange,
+		workerPoolSize:     defaultWorkerPoolSize,
+		ctx:                ctx,
+		cancel:             cancel,
+		bl:                 nil, // Do not create business logic until gateway status come
 	}
 }
 
+// SetPrefetchCount overrides the gateway's ingress QoS prefetch count. It
+// must be called before Start.
+func (c *GatewayChannel) SetPrefetchCount(n int) {
+	c.prefetchCount = n
+}
+
+// SetDeadLetterExchange overrides the exchange poison messages are routed
+// to. It must be called before Start.
+func (c *GatewayChannel) SetDeadLetterExchange(exchange string) {
+	c.deadLetterExchange = exchange
+}
+
+// SetWorkerPoolSize overrides how many ingress deliveries are processed
+// concurrently. It must be called before Start.
+func (c *GatewayChannel) SetWorkerPoolSize(n int) {
+	c.workerPoolSize = n
+}
+
+// inTopic is where the gateway publishes messages destined for the cloud.
+func (c *GatewayChannel) inTopic() string {
+	return c.gatewayId + ".in"
+}
+
+// outTopic is where the cloud publishes commands destined for the gateway.
+func (c *GatewayChannel) outTopic() string {
+	return c.gatewayId + ".out"
+}
+
+// Read only exists to satisfy interfaces.Channel's io.Reader embedding.
+// Ingress is now handled inline by handleMessage, registered as the
+// Broker.Subscribe callback in Start, so Read has nothing to deliver: it
+// blocks until the channel is closed.
 func (c *GatewayChannel) Read(p []byte) (n int, err error) {
-	return c.out.Read(p)
+	<-c.ctx.Done()
+	return 0, io.EOF
 }
 
 func (c *GatewayChannel) Write(p []byte) (n int, err error) {
-	return c.in.Write(p)
+	if err := c.br.Publish(c.outTopic(), p); err != nil {
+		return 0, err
+	}
+	metrics.MessagesPublishedTotal.WithLabelValues(c.gatewayId).Inc()
+	return len(p), nil
 }
 
 func (c *GatewayChannel) Close() error {
 	c.Stop()
-	return c.out.Close()
+	return nil
 }
 
 func (c GatewayChannel) PrintMessage(message entities.IotMessage) {
@@ -80,82 +133,90 @@ func (c GatewayChannel) PrintMessage(message entities.IotMessage) {
 }
 
 func (c *GatewayChannel) Start() {
-	// Read and process messages from gateway
-	go func() {
-		var mx sync.Mutex
-		buffer := make([]byte, 50*1024)
-	OUTER:
-		for {
-			select {
-			case <-c.ctx.Done():
-				break OUTER
-			default:
-				mx.Lock()
-				length, err := c.Read(buffer)
-				mx.Unlock()
-				if err != nil {
-					logger.Error("error reading channel", "error", err)
-					continue
-				}
-
-				// Start processing incoming message in a separate goroutine
-				go func() {
-					iotmessage := &entities.IotMessage{}
-					mx.Lock()
-					err := json.Unmarshal(buffer[:length], iotmessage)
-					mx.Unlock()
-					if err != nil {
-						logger.Error("can not unmarshal incoming gateway message",
-							"error", err,
-							"gateway", c.gatewayId)
-						return
-					}
-					// Print copy of incoming message to log
-					c.PrintMessage(*iotmessage)
-					// Load business logic if gateway is online and registered in database
-					if c.bl == nil {
-						exists, err := c.CheckGatewayExistence(iotmessage)
-						if err != nil {
-							logger.Error("error checking gateway in database",
-								"error", err,
-								"gateway", c.gatewayId,
-								"caller", "GatewayChannel")
-							return
-						}
-						if !exists {
-							logger.Warn("Gateway is not registered in cloud database",
-								"gateway", c.gatewayId,
-								"caller", "GatewayChannel")
-							return
-						}
-
-						// Create business logic
-						c.bl, err = c.CreateLogic()
-						if err != nil {
-							logger.Error("cannot load business logic params",
-								"error", err,
-								"gateway", c.gatewayId,
-								"caller", "GatewayChannel")
-						}
-					}
-
-					// Process incoming message
-					if err := c.bl.Process(iotmessage); err != nil {
-						logger.Error("error processing message",
-							"error", err,
-							"gateway", c.gatewayId,
-							"caller", "GatewayChannel")
-					}
-				}()
-			}
+	err := c.br.Subscribe(c.inTopic(), c.handleMessage,
+		WithPrefetchCount(c.prefetchCount), WithDeadLetterExchange(c.deadLetterExchange),
+		WithWorkerPoolSize(c.workerPoolSize))
+	if err != nil {
+		logger.Error("failed subscribing to gateway inbox",
+			"error", err, "gateway", c.gatewayId, "caller", "GatewayChannel")
+	}
+}
+
+// handleMessage processes one inbound message from the gateway. It is
+// invoked by the Broker for every delivery on inTopic(); a nil return acks
+// the delivery, a Permanent error sends it to the dead-letter exchange, and
+// any other error requeues it for a bounded number of retries.
+func (c *GatewayChannel) handleMessage(body []byte) error {
+	metrics.MessagesReceivedTotal.WithLabelValues(c.gatewayId).Inc()
+
+	iotmessage := &entities.IotMessage{}
+	if err := json.Unmarshal(body, iotmessage); err != nil {
+		metrics.UnmarshalErrorsTotal.WithLabelValues(c.gatewayId).Inc()
+		return Permanent(errors.Wrap(err, "can not unmarshal incoming gateway message"))
+	}
+	// Print copy of incoming message to log
+	c.PrintMessage(*iotmessage)
+
+	// Load business logic if gateway is online and registered in database.
+	// The worker pool dispatches concurrently for the same gateway, so the
+	// lazy init (and the read of c.bl) must be serialized.
+	c.blMu.Lock()
+	bl := c.bl
+	if bl == nil {
+		exists, err := c.CheckGatewayExistence(iotmessage)
+		if err != nil {
+			c.blMu.Unlock()
+			return errors.Wrap(err, "error checking gateway in database")
+		}
+		if !exists {
+			c.blMu.Unlock()
+			return Permanent(errors.Errorf("gateway %q is not registered in cloud database", c.gatewayId))
 		}
-	}()
+
+		// Create business logic
+		bl, err = c.CreateLogic()
+		if err != nil {
+			c.blMu.Unlock()
+			return errors.Wrap(err, "cannot load business logic params")
+		}
+		c.bl = bl
+	}
+	c.blMu.Unlock()
+
+	// Process incoming message
+	if err := bl.Process(iotmessage); err != nil {
+		return Permanent(errors.Wrap(err, "error processing message"))
+	}
+	return nil
+}
+
+// DoRPC sends request to the gateway and blocks until a correlated response
+// arrives or defaultRPCTimeout elapses.
+func (c *GatewayChannel) DoRPC(request *entities.IotMessage) (*entities.IotMessage, error) {
+	start := time.Now()
+	defer func() { metrics.ObserveRPCLatency(c.gatewayId, time.Since(start)) }()
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed marshaling RPC request")
+	}
+
+	reply, err := c.br.Request(c.outTopic(), payload, defaultRPCTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed making RPC request to gateway")
+	}
+
+	response := &entities.IotMessage{}
+	if err := json.Unmarshal(reply, response); err != nil {
+		return nil, errors.Wrap(err, "failed unmarshaling RPC response")
+	}
+	return response, nil
 }
 
 // Function creates business logic and loads params
 func (c *GatewayChannel) CreateLogic() (interfaces.Logic, error) {
 	bl := logic.NewGatewayLogic(c.ctx, c.conn, c.gatewayId)
-	if err := bl.LoadParams(c.in); err != nil {
+	if err := bl.LoadParams(c); err != nil {
 		return nil, err
 	}
 	return bl, nil
@@ -184,16 +245,6 @@ func (c *GatewayChannel) Stop() {
 	// Stop goroutines - fire context cancelling
 	c.cancel()
 
-	// Close i/o channels
-	if err := c.out.Close(); err != nil {
-		logger.Error("error closing gateway output channel",
-			"error", err, "caller", "GatewayChannel")
-	}
-	if err := c.in.Close(); err != nil {
-		logger.Error("error closing gateway input channel",
-			"error", err, "caller", "GatewayChannel")
-	}
-
 	// Change gateway and all its devices statuses to offline in database
 	statusMessage := messages.NewStatusMessage(c.gatewayId, "off")
 	tasks.NewUpdateGatewayStatusTask(c.conn).Run(statusMessage)
@@ -0,0 +1,195 @@
+// Package mqtt implements broker.Broker on top of MQTT. $SYS/broker/clients/#
+// only reports a connected-client count, not per-client IDs, so it cannot
+// stand in for RabbitMQ's event exchange; instead gateway presence is
+// derived from a retained "gateways/<id>/status" topic that each gateway is
+// expected to publish "online" to on connect and have the broker publish
+// "offline" to (as its MQTT Last Will) on disconnect.
+package mqtt
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/broker"
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/logger"
+)
+
+const (
+	// presenceTopicFilter matches the retained presence topic each gateway
+	// publishes "online"/"offline" to; see the package doc comment.
+	presenceTopicFilter = "gateways/+/status"
+
+	defaultRPCTimeout = 5 * time.Second
+)
+
+func init() {
+	broker.Register("mqtt", New)
+	broker.Register("mqtts", New)
+	broker.Register("tcp", New)
+	broker.Register("ssl", New)
+}
+
+// Broker is the MQTT implementation of broker.Broker.
+type Broker struct {
+	serverID string
+	url      string
+
+	client        mqtt.Client
+	gatewayEvents chan broker.GatewayEvent
+}
+
+// New builds an MQTT broker.Broker from a parsed mqtt(s):// URL.
+func New(serverID string, u *url.URL) (broker.Broker, error) {
+	return &Broker{
+		serverID:      serverID,
+		url:           u.String(),
+		gatewayEvents: make(chan broker.GatewayEvent, 16),
+	}, nil
+}
+
+// Connect dials the MQTT broker and subscribes to the gateway presence
+// topic. The paho client reconnects transparently, so Connect simply blocks
+// until ctx is cancelled.
+func (b *Broker) Connect(ctx context.Context) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.url).
+		SetClientID(b.serverID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Error("MQTT connection lost, reconnecting", "error", err, "caller", "mqtt.Broker")
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			logger.Info("connected to MQTT broker", "caller", "mqtt.Broker")
+			if token := c.Subscribe(presenceTopicFilter, 0, b.handlePresence); token.Wait() && token.Error() != nil {
+				logger.Error("failed subscribing to presence topic", "error", token.Error(), "caller", "mqtt.Broker")
+			}
+		})
+
+	b.client = mqtt.NewClient(opts)
+	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
+		return errors.Wrap(token.Error(), "failed connecting to MQTT broker")
+	}
+	defer b.client.Disconnect(250)
+
+	<-ctx.Done()
+	return nil
+}
+
+// handlePresence parses a "gateways/<id>/status" delivery into a
+// GatewayEvent. The payload is expected to be "online" (the gateway's own
+// retained publish on connect) or "offline" (the gateway's Last Will,
+// delivered by the broker on ungraceful disconnect).
+func (b *Broker) handlePresence(_ mqtt.Client, msg mqtt.Message) {
+	gatewayID, ok := gatewayIDFromPresenceTopic(msg.Topic())
+	if !ok {
+		return
+	}
+
+	var eventType broker.GatewayEventType
+	switch strings.TrimSpace(string(msg.Payload())) {
+	case "online":
+		eventType = broker.GatewayConnected
+	case "offline":
+		eventType = broker.GatewayDisconnected
+	default:
+		return
+	}
+
+	select {
+	case b.gatewayEvents <- broker.GatewayEvent{GatewayID: gatewayID, Type: eventType}:
+	default:
+		logger.Error("gateway events channel full, dropping event",
+			"gateway", gatewayID, "caller", "mqtt.Broker")
+	}
+}
+
+// gatewayIDFromPresenceTopic extracts <id> from a "gateways/<id>/status"
+// topic, as matched by presenceTopicFilter.
+func gatewayIDFromPresenceTopic(topic string) (string, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != "gateways" || parts[2] != "status" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// Subscribe registers handler for topic at QoS 0. broker.WithPrefetchCount
+// and broker.WithDeadLetterExchange have no MQTT equivalent and are ignored;
+// handler's returned error is only logged.
+func (b *Broker) Subscribe(topic string, handler func(msg []byte) error, _ ...broker.SubscribeOption) error {
+	if b.client == nil {
+		return errors.New("no connection to MQTT broker")
+	}
+	token := b.client.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		if err := handler(msg.Payload()); err != nil {
+			logger.Error("error handling message", "error", err, "topic", topic, "caller", "mqtt.Broker")
+		}
+	})
+	token.Wait()
+	return errors.Wrapf(token.Error(), "failed subscribing to topic %q", topic)
+}
+
+// Publish sends msg to topic at QoS 0.
+func (b *Broker) Publish(topic string, msg []byte) error {
+	if b.client == nil {
+		return errors.New("no connection to MQTT broker")
+	}
+	token := b.client.Publish(topic, 0, false, msg)
+	token.Wait()
+	return errors.Wrapf(token.Error(), "failed publishing to topic %q", topic)
+}
+
+// Request sends msg to topic and waits up to timeout for a reply on
+// topic+"/reply", since MQTT has no native request/reply pattern.
+func (b *Broker) Request(topic string, msg []byte, timeout time.Duration) ([]byte, error) {
+	if b.client == nil {
+		return nil, errors.New("no connection to MQTT broker")
+	}
+	if timeout <= 0 {
+		timeout = defaultRPCTimeout
+	}
+
+	replyTopic := topic + "/reply"
+	replyCh := make(chan []byte, 1)
+	token := b.client.Subscribe(replyTopic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case replyCh <- msg.Payload():
+		default:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		return nil, errors.Wrapf(token.Error(), "failed subscribing to reply topic %q", replyTopic)
+	}
+	defer b.client.Unsubscribe(replyTopic)
+
+	if err := b.Publish(topic, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-replyCh:
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, errors.Errorf("timed out waiting for reply on topic %q", replyTopic)
+	}
+}
+
+// GatewayEvents returns gateway connect/disconnect notifications derived
+// from the "gateways/<id>/status" presence topic.
+func (b *Broker) GatewayEvents() <-chan broker.GatewayEvent {
+	return b.gatewayEvents
+}
+
+// Close disconnects from the MQTT broker.
+func (b *Broker) Close() error {
+	if b.client != nil {
+		b.client.Disconnect(250)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Package nats implements broker.Broker on top of NATS, deriving gateway
+// presence from the server's $SYS.> event subjects instead of a RabbitMQ
+// event exchange. Reading $SYS.> requires connecting as a user in the
+// server's system account, so the nats:// URL passed to New must carry
+// credentials for that account, not a regular client account.
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/broker"
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/logger"
+)
+
+const (
+	connectedSubject    = "$SYS.ACCOUNT.*.CONNECT"
+	disconnectedSubject = "$SYS.ACCOUNT.*.DISCONNECT"
+)
+
+// connectEventMsg is the subset of nats-server's system account connect/
+// disconnect event payload (server.ConnectEventMsg/DisconnectEventMsg) this
+// driver needs: the connecting client's name, which gateways are expected to
+// set to their gatewayID via nats.Name when dialing.
+type connectEventMsg struct {
+	Client struct {
+		Name string `json:"name"`
+	} `json:"client"`
+}
+
+func init() {
+	broker.Register("nats", New)
+}
+
+// Broker is the NATS implementation of broker.Broker.
+type Broker struct {
+	serverID string
+	url      string
+
+	nc            *nats.Conn
+	gatewayEvents chan broker.GatewayEvent
+}
+
+// New builds a NATS broker.Broker from a parsed nats:// URL.
+func New(serverID string, u *url.URL) (broker.Broker, error) {
+	return &Broker{
+		serverID:      serverID,
+		url:           u.String(),
+		gatewayEvents: make(chan broker.GatewayEvent, 16),
+	}, nil
+}
+
+// Connect dials NATS and subscribes to the $SYS.> client presence subjects.
+// b.url must authenticate as a system account user for those subscriptions
+// to receive anything. NATS clients reconnect transparently
+// (nats.ReconnectWait/MaxReconnects), so Connect simply blocks until ctx is
+// cancelled.
+func (b *Broker) Connect(ctx context.Context) error {
+	nc, err := nats.Connect(b.url,
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Error("NATS connection lost, reconnecting", "error", err, "caller", "nats.Broker")
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info("NATS connection restored", "caller", "nats.Broker")
+		}),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed connecting to NATS")
+	}
+	b.nc = nc
+	defer nc.Close()
+
+	if _, err := nc.Subscribe(connectedSubject, b.handlePresence(broker.GatewayConnected)); err != nil {
+		return errors.Wrap(err, "failed subscribing to connect events")
+	}
+	if _, err := nc.Subscribe(disconnectedSubject, b.handlePresence(broker.GatewayDisconnected)); err != nil {
+		return errors.Wrap(err, "failed subscribing to disconnect events")
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (b *Broker) handlePresence(eventType broker.GatewayEventType) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		var event connectEventMsg
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			logger.Error("failed parsing system account presence event",
+				"error", err, "subject", msg.Subject, "caller", "nats.Broker")
+			return
+		}
+
+		gatewayID := strings.TrimSpace(event.Client.Name)
+		if gatewayID == "" {
+			return
+		}
+		select {
+		case b.gatewayEvents <- broker.GatewayEvent{GatewayID: gatewayID, Type: eventType}:
+		default:
+			logger.Error("gateway events channel full, dropping event",
+				"gateway", gatewayID, "caller", "nats.Broker")
+		}
+	}
+}
+
+// Subscribe registers handler for topic. NATS core pub/sub has no
+// server-side ack/redelivery or dead-letter concept, so any
+// broker.SubscribeOption is ignored and handler's returned error is only
+// logged.
+func (b *Broker) Subscribe(topic string, handler func(msg []byte) error, _ ...broker.SubscribeOption) error {
+	if b.nc == nil {
+		return errors.New("no connection to NATS broker")
+	}
+	_, err := b.nc.Subscribe(topic, func(msg *nats.Msg) {
+		if err := handler(msg.Data); err != nil {
+			logger.Error("error handling message", "error", err, "subject", topic, "caller", "nats.Broker")
+		}
+	})
+	return errors.Wrapf(err, "failed subscribing to subject %q", topic)
+}
+
+// Publish sends msg to topic.
+func (b *Broker) Publish(topic string, msg []byte) error {
+	if b.nc == nil {
+		return errors.New("no connection to NATS broker")
+	}
+	return errors.Wrapf(b.nc.Publish(topic, msg), "failed publishing to subject %q", topic)
+}
+
+// Request sends msg to topic and waits up to timeout for a reply, using
+// NATS's native request/reply.
+func (b *Broker) Request(topic string, msg []byte, timeout time.Duration) ([]byte, error) {
+	if b.nc == nil {
+		return nil, errors.New("no connection to NATS broker")
+	}
+	reply, err := b.nc.Request(topic, msg, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed request on subject %q", topic)
+	}
+	return reply.Data, nil
+}
+
+// GatewayEvents returns gateway connect/disconnect notifications derived
+// from $SYS.> presence subjects.
+func (b *Broker) GatewayEvents() <-chan broker.GatewayEvent {
+	return b.gatewayEvents
+}
+
+// Close closes the NATS connection without draining pending messages.
+func (b *Broker) Close() error {
+	if b.nc != nil {
+		b.nc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/logger"
+)
+
+// maxDLQScan bounds how many messages a single List/Purge call will browse,
+// so an operator hitting the inspector can't accidentally block a queue
+// consumer for an unbounded amount of time.
+const maxDLQScan = 1000
+
+// DeadLetter is a poison message sitting in the shared dead-letter queue,
+// attributed to the gateway named by its routing key.
+type DeadLetter struct {
+	GatewayID string     `json:"gateway_id"`
+	Body      []byte     `json:"body"`
+	Headers   amqp.Table `json:"headers,omitempty"`
+}
+
+// DLQInspector lets operators list, replay or purge poison messages that
+// ended up in the catch-all dead-letter queue behind exchange (see
+// broker.WithDeadLetterExchange / ensureDeadLetterExchange).
+type DLQInspector struct {
+	br       *Broker
+	exchange string
+}
+
+// NewDLQInspector builds an inspector for the DLQ behind exchange, on broker
+// br.
+func NewDLQInspector(br *Broker, exchange string) *DLQInspector {
+	return &DLQInspector{br: br, exchange: exchange}
+}
+
+func (i *DLQInspector) queueName() string {
+	return i.exchange + ".dlq"
+}
+
+func (i *DLQInspector) channel() (*amqp.Channel, error) {
+	i.br.mu.RLock()
+	conn := i.br.conn
+	i.br.mu.RUnlock()
+	if conn == nil {
+		return nil, errors.New("no connection to RabbitMQ broker")
+	}
+	return conn.Channel()
+}
+
+func gatewayIDOf(d amqp.Delivery) string {
+	parts := strings.SplitN(d.RoutingKey, ".", 2)
+	return parts[0]
+}
+
+// List browses (without consuming) up to limit dead-lettered messages for
+// gatewayID, or every gateway if gatewayID is empty.
+func (i *DLQInspector) List(gatewayID string, limit int) ([]DeadLetter, error) {
+	ch, err := i.channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	var matched []DeadLetter
+	var scanned []amqp.Delivery
+	for len(matched) < limit && len(scanned) < maxDLQScan {
+		d, ok, err := ch.Get(i.queueName(), false)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed browsing dead-letter queue")
+		}
+		if !ok {
+			break
+		}
+		scanned = append(scanned, d)
+		if gatewayID == "" || gatewayIDOf(d) == gatewayID {
+			matched = append(matched, DeadLetter{GatewayID: gatewayIDOf(d), Body: d.Body, Headers: d.Headers})
+		}
+	}
+
+	// Get() removes messages from the queue; put everything back since List
+	// is meant to be a non-destructive peek.
+	for _, d := range scanned {
+		_ = d.Nack(false, true)
+	}
+	return matched, nil
+}
+
+// Replay republishes the first dead-lettered message for gatewayID back to
+// its original ingress topic and removes it from the DLQ.
+func (i *DLQInspector) Replay(gatewayID string) error {
+	ch, err := i.channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	var toRequeue []amqp.Delivery
+	var replayed bool
+	for scanned := 0; scanned < maxDLQScan; scanned++ {
+		d, ok, err := ch.Get(i.queueName(), false)
+		if err != nil {
+			return errors.Wrap(err, "failed browsing dead-letter queue")
+		}
+		if !ok {
+			break
+		}
+		if !replayed && gatewayIDOf(d) == gatewayID {
+			topic := gatewayID + ".in"
+			if err := ch.Publish("", topic, false, false, amqp.Publishing{
+				ContentType: d.ContentType,
+				Body:        d.Body,
+			}); err != nil {
+				toRequeue = append(toRequeue, d)
+				continue
+			}
+			_ = d.Ack(false)
+			replayed = true
+			continue
+		}
+		toRequeue = append(toRequeue, d)
+	}
+
+	for _, d := range toRequeue {
+		_ = d.Nack(false, true)
+	}
+	if !replayed {
+		return errors.Errorf("no dead-lettered message found for gateway %q", gatewayID)
+	}
+	return nil
+}
+
+// Purge removes the dead-lettered messages for gatewayID found among the
+// first maxDLQScan messages of the DLQ (or every message, if gatewayID is
+// empty) and returns how many were removed.
+func (i *DLQInspector) Purge(gatewayID string) (int, error) {
+	ch, err := i.channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	if gatewayID == "" {
+		n, err := ch.QueuePurge(i.queueName(), false)
+		return n, errors.Wrap(err, "failed purging dead-letter queue")
+	}
+
+	var toRequeue []amqp.Delivery
+	removed := 0
+	for scanned := 0; scanned < maxDLQScan; scanned++ {
+		d, ok, err := ch.Get(i.queueName(), false)
+		if err != nil {
+			return removed, errors.Wrap(err, "failed browsing dead-letter queue")
+		}
+		if !ok {
+			break
+		}
+		if gatewayIDOf(d) == gatewayID {
+			_ = d.Ack(false)
+			removed++
+			continue
+		}
+		toRequeue = append(toRequeue, d)
+	}
+
+	for _, d := range toRequeue {
+		_ = d.Nack(false, true)
+	}
+	return removed, nil
+}
+
+// Handler exposes List/Replay/Purge over a small HTTP API:
+//
+//	GET    /dlq?gateway=<id>&limit=<n>  list poison messages
+//	POST   /dlq/replay?gateway=<id>     replay one poison message
+//	DELETE /dlq?gateway=<id>            purge poison messages (gateway optional)
+func (i *DLQInspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dlq", i.handleDLQ)
+	mux.HandleFunc("/dlq/replay", i.handleReplay)
+	return mux
+}
+
+func (i *DLQInspector) handleDLQ(w http.ResponseWriter, r *http.Request) {
+	gatewayID := r.URL.Query().Get("gateway")
+
+	switch r.Method {
+	case http.MethodGet:
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				limit = n
+			}
+		}
+		messages, err := i.List(gatewayID, limit)
+		if err != nil {
+			logger.Error("failed listing dead letters", "error", err, "caller", "DLQInspector")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(messages)
+	case http.MethodDelete:
+		removed, err := i.Purge(gatewayID)
+		if err != nil {
+			logger.Error("failed purging dead letters", "error", err, "caller", "DLQInspector")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (i *DLQInspector) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gatewayID := r.URL.Query().Get("gateway")
+	if gatewayID == "" {
+		http.Error(w, "missing gateway parameter", http.StatusBadRequest)
+		return
+	}
+	if err := i.Replay(gatewayID); err != nil {
+		logger.Error("failed replaying dead letter", "error", err, "gateway", gatewayID, "caller", "DLQInspector")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
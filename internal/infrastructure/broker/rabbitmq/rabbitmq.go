@@ -0,0 +1,755 @@
+// Package rabbitmq implements broker.Broker on top of RabbitMQ/AMQP 0-9-1,
+// using the server-wide event exchange ("amq.rabbitmq.event") to surface
+// gateway presence and plain queues (named after the topic) for pub/sub and
+// RPC.
+package rabbitmq
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/broker"
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/logger"
+	"github.com/AcroManiac/iot-cloud-server/internal/infrastructure/metrics"
+)
+
+const (
+	eventExchange = "amq.rabbitmq.event"
+	eventRouting  = "queue.*"
+
+	// reconnect backoff parameters: initial 1s, doubling, capped at 30s, with jitter
+	reconnectInitialBackoff = 1 * time.Second
+	reconnectMaxBackoff     = 30 * time.Second
+	reconnectBackoffFactor  = 2
+
+	defaultRPCTimeout = 5 * time.Second
+
+	// publishConfirmTimeout bounds how long a confirmed Publish/Request waits
+	// for the broker to ack (or nack) a message before giving up.
+	publishConfirmTimeout = 5 * time.Second
+
+	// maxIngressRetries bounds how many times a transient handler error
+	// requeues a gateway ingress delivery before it is given up on and
+	// dead-lettered for good.
+	maxIngressRetries = 5
+
+	// retryRequeueDelay is how long a retried delivery sits in its per-topic
+	// retry queue before the broker dead-letters it back to the origin
+	// queue, recording the attempt in x-death.
+	retryRequeueDelay = 5 * time.Second
+
+	// defaultWorkerPoolSize bounds how many deliveries a subscription handles
+	// concurrently when SubscribeOptions.WorkerPoolSize is unset.
+	defaultWorkerPoolSize = 16
+)
+
+func init() {
+	broker.Register("amqp", New)
+	broker.Register("amqps", New)
+}
+
+type subscription struct {
+	topic   string
+	handler func(msg []byte) error
+	opts    broker.SubscribeOptions
+}
+
+// Broker is the RabbitMQ implementation of broker.Broker.
+type Broker struct {
+	serverID       string
+	url            string
+	tlsCfg         *tls.Config
+	confirmPublish bool
+
+	mu   sync.RWMutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+
+	// confirmMu serializes publishes made with confirmPublish enabled, so a
+	// confirmation/return read off confirms/returns always belongs to the
+	// in-flight publish that is waiting for it.
+	confirmMu sync.Mutex
+	confirms  <-chan amqp.Confirmation
+	returns   <-chan amqp.Return
+
+	subsMu sync.Mutex
+	subs   []*subscription
+
+	gatewayEvents chan broker.GatewayEvent
+}
+
+// New builds a RabbitMQ broker.Broker from a parsed amqp(s):// URL. Publisher
+// confirms are opt-in via the "confirms=true" query parameter. For amqps://
+// URLs, the TLS material is taken from the "cacert", "cert", "key" and
+// "insecureSkipVerify" query parameters - the NewBroker driver registry only
+// threads a URL through to each driver's constructor, so this is where the
+// app's config file's PEM paths end up, rather than a *tls.Config passed in
+// directly. The peer chain is validated with a throwaway dial right here in
+// New, so a misconfigured certificate fails loudly at startup instead of
+// being silently retried forever by Connect's backoff loop (or failing only
+// on the first publish).
+func New(serverID string, u *url.URL) (broker.Broker, error) {
+	b := &Broker{
+		serverID:       serverID,
+		url:            u.String(),
+		confirmPublish: u.Query().Get("confirms") == "true",
+		gatewayEvents:  make(chan broker.GatewayEvent, 16),
+	}
+
+	if u.Scheme == "amqps" {
+		tlsCfg, err := buildTLSConfig(u.Query())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed building TLS config")
+		}
+		b.tlsCfg = tlsCfg
+
+		conn, err := amqp.DialTLS(b.url, b.tlsCfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed validating TLS connection to RabbitMQ")
+		}
+		_ = conn.Close()
+	}
+
+	return b, nil
+}
+
+// buildTLSConfig loads the CA bundle and optional client certificate/key
+// referenced by an amqps:// URL's query parameters into a *tls.Config.
+func buildTLSConfig(q url.Values) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: q.Get("insecureSkipVerify") == "true",
+	}
+
+	if caPath := q.Get("cacert"); caPath != "" {
+		caCert, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed reading CA bundle %q", caPath)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.Errorf("failed parsing CA bundle %q", caPath)
+		}
+		cfg.RootCAs = pool
+	}
+
+	certPath, keyPath := q.Get("cert"), q.Get("key")
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed loading client certificate %q / key %q", certPath, keyPath)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Connect dials RabbitMQ and supervises the connection, redialing with
+// exponential backoff and jitter until ctx is cancelled. After every
+// (re)connect it re-declares the event exchange queue and re-subscribes
+// every topic previously registered via Subscribe.
+func (b *Broker) Connect(ctx context.Context) error {
+	backoff := reconnectInitialBackoff
+	reconnecting := false
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if reconnecting {
+			metrics.ReconnectsTotal.WithLabelValues(b.serverID).Inc()
+		}
+		reconnecting = true
+
+		if err := b.dial(); err != nil {
+			logger.Error("failed connecting to RabbitMQ, will retry", "error", err, "caller", "rabbitmq.Broker")
+			if !sleepBackoff(ctx, &backoff) {
+				return nil
+			}
+			continue
+		}
+
+		if err := b.initEventExchange(); err != nil {
+			logger.Error("failed initializing event exchange, will retry", "error", err, "caller", "rabbitmq.Broker")
+			b.closeConn()
+			if !sleepBackoff(ctx, &backoff) {
+				return nil
+			}
+			continue
+		}
+
+		if err := b.resubscribeAll(); err != nil {
+			logger.Error("failed resubscribing topics, will retry", "error", err, "caller", "rabbitmq.Broker")
+			b.closeConn()
+			if !sleepBackoff(ctx, &backoff) {
+				return nil
+			}
+			continue
+		}
+
+		backoff = reconnectInitialBackoff
+		logger.Info("connected to RabbitMQ broker", "caller", "rabbitmq.Broker")
+
+		if !b.waitUntilDisconnected(ctx) {
+			return nil
+		}
+	}
+}
+
+func (b *Broker) dial() error {
+	var conn *amqp.Connection
+	var err error
+	if b.tlsCfg != nil {
+		conn, err = amqp.DialTLS(b.url, b.tlsCfg)
+	} else {
+		conn, err = amqp.Dial(b.url)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed connecting to RabbitMQ")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrap(err, "failed to open a channel")
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	var confirms <-chan amqp.Confirmation
+	if b.confirmPublish {
+		if err := ch.Confirm(false); err != nil {
+			_ = conn.Close()
+			return errors.Wrap(err, "failed putting channel into confirm mode")
+		}
+		confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		// publish() waits on returns itself while a confirmed publish is in
+		// flight, so nothing else must read from it here.
+	} else {
+		// publish() never waits on returns when confirms are disabled, so an
+		// unread NotifyReturn (cap 1) would block the channel's frame
+		// dispatch - which also serves the event consumer - after a single
+		// unroutable mandatory publish. Drain it in the background instead.
+		go drainReturns(returns)
+	}
+
+	b.mu.Lock()
+	b.conn = conn
+	b.ch = ch
+	b.confirms = confirms
+	b.returns = returns
+	b.mu.Unlock()
+	return nil
+}
+
+// drainReturns logs unroutable mandatory publishes when no in-flight
+// publish() call is waiting on returns itself, i.e. whenever confirms are
+// disabled.
+func drainReturns(returns <-chan amqp.Return) {
+	for ret := range returns {
+		logger.Error("message was unroutable", "routing_key", ret.RoutingKey,
+			"reply_text", ret.ReplyText, "caller", "rabbitmq.Broker")
+	}
+}
+
+func (b *Broker) closeConn() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ch != nil {
+		_ = b.ch.Close()
+	}
+	if b.conn != nil {
+		_ = b.conn.Close()
+	}
+}
+
+func (b *Broker) initEventExchange() error {
+	b.mu.RLock()
+	ch := b.ch
+	b.mu.RUnlock()
+	if ch == nil {
+		return errors.New("no connection to RabbitMQ broker")
+	}
+
+	queue, err := ch.QueueDeclare(b.serverID, false, false, true, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to declare an event queue")
+	}
+
+	if err := ch.QueueBind(queue.Name, eventRouting, eventExchange, false, nil); err != nil {
+		return errors.Wrap(err, "failed to bind an event queue")
+	}
+
+	deliveries, err := ch.Consume(queue.Name, "", true, false, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to register an event consumer")
+	}
+
+	go b.processEvents(deliveries)
+	return nil
+}
+
+func (b *Broker) processEvents(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		name, ok := d.Headers["name"].(string)
+		if !ok {
+			continue
+		}
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts) < 2 || parts[1] != "in" {
+			continue
+		}
+
+		var eventType broker.GatewayEventType
+		switch d.RoutingKey {
+		case "queue.created":
+			eventType = broker.GatewayConnected
+		case "queue.deleted":
+			eventType = broker.GatewayDisconnected
+		default:
+			continue
+		}
+
+		select {
+		case b.gatewayEvents <- broker.GatewayEvent{GatewayID: parts[0], Type: eventType}:
+		default:
+			logger.Error("gateway events channel full, dropping event",
+				"gateway", parts[0], "caller", "rabbitmq.Broker")
+		}
+	}
+}
+
+func (b *Broker) resubscribeAll() error {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for _, s := range b.subs {
+		if err := b.subscribeLocked(s.topic, s.handler, s.opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Broker) waitUntilDisconnected(ctx context.Context) bool {
+	b.mu.RLock()
+	conn, ch := b.conn, b.ch
+	b.mu.RUnlock()
+
+	connClose := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClose := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	select {
+	case <-ctx.Done():
+		b.closeConn()
+		return false
+	case err := <-connClose:
+		logger.Error("RabbitMQ connection closed, reconnecting", "error", err, "caller", "rabbitmq.Broker")
+	case err := <-chClose:
+		logger.Error("RabbitMQ channel closed, reconnecting", "error", err, "caller", "rabbitmq.Broker")
+	}
+	return true
+}
+
+// Subscribe registers handler for topic, declaring a matching queue and
+// consumer on a dedicated channel (so per-subscription QoS doesn't affect
+// any other gateway). It is re-run automatically after every reconnect.
+func (b *Broker) Subscribe(topic string, handler func(msg []byte) error, opts ...broker.SubscribeOption) error {
+	var options broker.SubscribeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	b.subs = append(b.subs, &subscription{topic: topic, handler: handler, opts: options})
+	return b.subscribeLocked(topic, handler, options)
+}
+
+func (b *Broker) subscribeLocked(topic string, handler func(msg []byte) error, opts broker.SubscribeOptions) error {
+	b.mu.RLock()
+	conn := b.conn
+	b.mu.RUnlock()
+	if conn == nil {
+		return errors.New("no connection to RabbitMQ broker")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return errors.Wrapf(err, "failed opening consumer channel for topic %q", topic)
+	}
+
+	if opts.PrefetchCount > 0 {
+		if err := ch.Qos(opts.PrefetchCount, 0, false); err != nil {
+			return errors.Wrapf(err, "failed setting QoS for topic %q", topic)
+		}
+	}
+
+	var args amqp.Table
+	if opts.DeadLetterExchange != "" {
+		if err := b.ensureDeadLetterExchange(ch, opts.DeadLetterExchange); err != nil {
+			return err
+		}
+		if err := b.ensureRetryQueue(ch, topic); err != nil {
+			return err
+		}
+		args = amqp.Table{"x-dead-letter-exchange": opts.DeadLetterExchange}
+	}
+
+	queue, err := ch.QueueDeclare(topic, false, false, false, false, args)
+	if err != nil {
+		return errors.Wrapf(err, "failed declaring queue for topic %q", topic)
+	}
+
+	// Manual ack: success acks, a Permanent error (or one that has already
+	// exhausted its retries) is nacked without requeue so it is dead-lettered
+	// (or simply dropped, if no DeadLetterExchange is configured), and any
+	// other error is retried: through the topic's retry queue when a
+	// DeadLetterExchange is configured, otherwise by a nack with requeue.
+	deliveries, err := ch.Consume(queue.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed registering consumer for topic %q", topic)
+	}
+
+	poolSize := opts.WorkerPoolSize
+	if poolSize <= 0 {
+		poolSize = defaultWorkerPoolSize
+	}
+	b.dispatch(ch, topic, deliveries, poolSize, handler, opts)
+	return nil
+}
+
+// dispatch feeds deliveries into a bounded pool of poolSize workers instead
+// of spawning one goroutine per delivery. Once every worker is busy and the
+// jobs channel is full, the dispatch loop blocks on sending, which stops it
+// reading further off deliveries - applying backpressure all the way back to
+// the broker via QoS/prefetch instead of growing goroutines unboundedly.
+func (b *Broker) dispatch(ch *amqp.Channel, topic string, deliveries <-chan amqp.Delivery, poolSize int, handler func(msg []byte) error, opts broker.SubscribeOptions) {
+	jobs := make(chan amqp.Delivery, poolSize)
+
+	for i := 0; i < poolSize; i++ {
+		go func() {
+			for d := range jobs {
+				b.handleDelivery(ch, topic, d, handler, opts)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for d := range deliveries {
+			jobs <- d
+		}
+	}()
+}
+
+// handleDelivery runs handler against a single delivery and acks/nacks it
+// according to the outcome, dead-lettering poison messages instead of
+// silently dropping them. When opts.DeadLetterExchange is set, transient
+// errors are routed through a per-topic retry queue (see ensureRetryQueue)
+// rather than requeued in place, so each attempt is recorded in x-death and
+// deathCount can cap the retries; without it they are requeued in place with
+// no retry cap.
+func (b *Broker) handleDelivery(ch *amqp.Channel, topic string, d amqp.Delivery, handler func(msg []byte) error, opts broker.SubscribeOptions) {
+	err := handler(d.Body)
+	switch {
+	case err == nil:
+		_ = d.Ack(false)
+	case broker.IsPermanent(err):
+		logger.Error("rejecting poison message", "error", err, "routing_key", d.RoutingKey, "caller", "rabbitmq.Broker")
+		_ = d.Nack(false, false)
+	case opts.DeadLetterExchange == "":
+		// No dead-letter topology configured for this subscription, so fall
+		// back to plain in-queue redelivery.
+		logger.Error("transient error handling message, requeueing",
+			"error", err, "routing_key", d.RoutingKey, "caller", "rabbitmq.Broker")
+		_ = d.Nack(false, true)
+	case deathCount(d) >= maxIngressRetries:
+		logger.Error("giving up on message after max retries, dead-lettering",
+			"error", err, "routing_key", d.RoutingKey, "retries", deathCount(d), "caller", "rabbitmq.Broker")
+		_ = d.Nack(false, false)
+	default:
+		logger.Error("transient error handling message, scheduling retry",
+			"error", err, "routing_key", d.RoutingKey, "retries", deathCount(d), "caller", "rabbitmq.Broker")
+		if pubErr := ch.Publish("", topicRetryQueue(topic), false, false, amqp.Publishing{
+			ContentType: d.ContentType,
+			Headers:     d.Headers,
+			Body:        d.Body,
+		}); pubErr != nil {
+			logger.Error("failed scheduling retry, requeueing immediately",
+				"error", pubErr, "routing_key", d.RoutingKey, "caller", "rabbitmq.Broker")
+			_ = d.Nack(false, true)
+			return
+		}
+		_ = d.Ack(false)
+	}
+}
+
+// deathCount sums the per-hop redelivery counts recorded in the AMQP
+// "x-death" header, i.e. how many times this message has already been
+// dead-lettered.
+func deathCount(d amqp.Delivery) int {
+	deaths, ok := d.Headers["x-death"].([]interface{})
+	if !ok {
+		return 0
+	}
+	total := 0
+	for _, entry := range deaths {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if count, ok := table["count"].(int64); ok {
+			total += int(count)
+		}
+	}
+	return total
+}
+
+// topicRetryQueue names the delay queue a topic's retried deliveries sit in
+// until their TTL dead-letters them back to topic.
+func topicRetryQueue(topic string) string {
+	return topic + ".retry"
+}
+
+// ensureRetryQueue idempotently declares the per-topic retry queue
+// handleDelivery republishes transient failures into: messages sit there for
+// retryRequeueDelay, then RabbitMQ dead-letters them back to topic via the
+// default exchange, recording the attempt in x-death.
+func (b *Broker) ensureRetryQueue(ch *amqp.Channel, topic string) error {
+	_, err := ch.QueueDeclare(topicRetryQueue(topic), true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": topic,
+		"x-message-ttl":             int64(retryRequeueDelay / time.Millisecond),
+	})
+	return errors.Wrapf(err, "failed declaring retry queue for topic %q", topic)
+}
+
+// ensureDeadLetterExchange idempotently declares the per-server dead-letter
+// exchange and a catch-all DLQ bound to it, so poison messages from every
+// gateway land somewhere an operator can inspect (see DLQInspector).
+func (b *Broker) ensureDeadLetterExchange(ch *amqp.Channel, exchange string) error {
+	if err := ch.ExchangeDeclare(exchange, "fanout", true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "failed declaring dead-letter exchange %q", exchange)
+	}
+	if _, err := ch.QueueDeclare(exchange+".dlq", true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "failed declaring dead-letter queue for exchange %q", exchange)
+	}
+	if err := ch.QueueBind(exchange+".dlq", "", exchange, false, nil); err != nil {
+		return errors.Wrapf(err, "failed binding dead-letter queue for exchange %q", exchange)
+	}
+	return nil
+}
+
+// Publish sends msg to the queue named topic. Messages are published
+// mandatory so unroutable deliveries come back via NotifyReturn instead of
+// vanishing. If confirms are enabled, Publish waits for the broker's ack and
+// returns an unroutable delivery as an error; if they are disabled, Publish
+// returns without waiting and an unroutable delivery is only logged, not
+// returned as an error.
+func (b *Broker) Publish(topic string, msg []byte) error {
+	b.mu.RLock()
+	ch := b.ch
+	b.mu.RUnlock()
+	if ch == nil {
+		return errors.New("no connection to RabbitMQ broker")
+	}
+
+	if _, err := ch.QueueDeclare(topic, false, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "failed declaring queue for topic %q", topic)
+	}
+
+	return b.publish(ch, topic, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        msg,
+	})
+}
+
+// publish sends publishing to topic via the default exchange, mandatory, and
+// - when confirmPublish is set - blocks until the broker acks/nacks it or
+// publishConfirmTimeout elapses.
+func (b *Broker) publish(ch *amqp.Channel, topic string, publishing amqp.Publishing) error {
+	if !b.confirmPublish {
+		return ch.Publish("", topic, true, false, publishing)
+	}
+
+	b.confirmMu.Lock()
+	defer b.confirmMu.Unlock()
+
+	if err := ch.Publish("", topic, true, false, publishing); err != nil {
+		return errors.Wrapf(err, "failed publishing to topic %q", topic)
+	}
+
+	timer := time.NewTimer(publishConfirmTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ret, ok := <-b.returns:
+			if ok {
+				// An unroutable mandatory publish produces both a
+				// basic.return and a publisher ack for the same delivery;
+				// drain the matching ack now so the next publish() doesn't
+				// read it as its own confirmation.
+				select {
+				case <-b.confirms:
+				case <-timer.C:
+				}
+				return errors.Errorf("message to %q was unroutable: %s", ret.RoutingKey, ret.ReplyText)
+			}
+		case conf, ok := <-b.confirms:
+			if !ok {
+				return errors.New("publish confirmation channel closed")
+			}
+			// The broker always sends the basic.return for an unroutable
+			// mandatory publish before the matching ack, so if this was that
+			// case the return is already sitting in b.returns by now - check
+			// for it before trusting conf.Ack, since select would otherwise
+			// pick between the two cases at random when both are ready.
+			select {
+			case ret, ok := <-b.returns:
+				if ok {
+					return errors.Errorf("message to %q was unroutable: %s", ret.RoutingKey, ret.ReplyText)
+				}
+			default:
+			}
+			if !conf.Ack {
+				return errors.Errorf("broker nacked publish to topic %q", topic)
+			}
+			return nil
+		case <-timer.C:
+			return errors.Errorf("timed out waiting for publish confirmation on topic %q", topic)
+		}
+	}
+}
+
+// Request sends msg to topic and waits up to timeout for a correlated reply
+// on a private, exclusive reply-to queue.
+func (b *Broker) Request(topic string, msg []byte, timeout time.Duration) ([]byte, error) {
+	if timeout <= 0 {
+		timeout = defaultRPCTimeout
+	}
+
+	b.mu.RLock()
+	ch := b.ch
+	b.mu.RUnlock()
+	if ch == nil {
+		return nil, errors.New("no connection to RabbitMQ broker")
+	}
+
+	replyQueue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed declaring reply queue")
+	}
+
+	deliveries, err := ch.Consume(replyQueue.Name, "", true, false, false, false, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed registering reply consumer")
+	}
+
+	correlationID := generateCorrelationID()
+	if _, err := ch.QueueDeclare(topic, false, false, false, false, nil); err != nil {
+		return nil, errors.Wrapf(err, "failed declaring queue for topic %q", topic)
+	}
+	err = b.publish(ch, topic, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: correlationID,
+		ReplyTo:       replyQueue.Name,
+		Body:          msg,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed publishing request to topic %q", topic)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil, errors.Errorf("timed out waiting for reply on topic %q", topic)
+		case d, ok := <-deliveries:
+			if !ok {
+				return nil, errors.Errorf("reply channel closed while waiting on topic %q", topic)
+			}
+			if d.CorrelationId != correlationID {
+				continue
+			}
+			return d.Body, nil
+		}
+	}
+}
+
+// GatewayEvents returns gateway connect/disconnect notifications derived
+// from the "amq.rabbitmq.event" exchange.
+func (b *Broker) GatewayEvents() <-chan broker.GatewayEvent {
+	return b.gatewayEvents
+}
+
+// Close releases the RabbitMQ channel and connection.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ch != nil {
+		if err := b.ch.Close(); err != nil {
+			return errors.Wrap(err, "error closing management channel")
+		}
+	}
+	if b.conn != nil {
+		if err := b.conn.Close(); err != nil {
+			return errors.Wrap(err, "error closing connection to broker")
+		}
+	}
+	return nil
+}
+
+// generateCorrelationID returns a random hex string used to match a Request
+// with its reply delivery.
+func generateCorrelationID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(mrand.Int63(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// sleepBackoff waits a random duration between half and all of the current
+// backoff (or until ctx is cancelled) and advances backoff towards
+// reconnectMaxBackoff. It returns
+// false if ctx was cancelled while waiting.
+func sleepBackoff(ctx context.Context, backoff *time.Duration) bool {
+	wait := *backoff/2 + time.Duration(mrand.Int63n(int64(*backoff/2+1)))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	}
+
+	*backoff *= reconnectBackoffFactor
+	if *backoff > reconnectMaxBackoff {
+		*backoff = reconnectMaxBackoff
+	}
+	return true
+}
+
+// DialURL builds an amqp(s):// URL from discrete connection parameters,
+// kept for callers migrating from the old Manager constructor fields.
+func DialURL(protocol, user, password, host string, port int) string {
+	return fmt.Sprintf("%s://%s:%s@%s:%s/", protocol, user, password, host, strconv.Itoa(port))
+}